@@ -0,0 +1,39 @@
+package melody
+
+import "sync"
+
+// historyRing is a fixed-capacity ring buffer of the most recently
+// broadcast envelopes, used to replay history to newly connected sessions.
+type historyRing struct {
+	mu       sync.RWMutex
+	messages []*envelope
+}
+
+func newHistoryRing() *historyRing {
+	return &historyRing{}
+}
+
+// add appends e to the ring, trimming the oldest entries once len exceeds max.
+// A max of zero or less disables history and the ring stays empty.
+func (h *historyRing) add(e *envelope, max int) {
+	if max <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	h.messages = append(h.messages, e)
+	if len(h.messages) > max {
+		h.messages = h.messages[len(h.messages)-max:]
+	}
+	h.mu.Unlock()
+}
+
+// snapshot returns a copy of the currently buffered envelopes, oldest first.
+func (h *historyRing) snapshot() []*envelope {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	out := make([]*envelope, len(h.messages))
+	copy(out, h.messages)
+	return out
+}
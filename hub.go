@@ -0,0 +1,90 @@
+package melody
+
+import "sync"
+
+// hub maintains the set of active sessions and fans broadcast envelopes
+// out to them.
+type hub struct {
+	sessions   map[*Session]bool
+	broadcast  chan *envelope
+	register   chan *Session
+	unregister chan *Session
+	exit       chan *envelope
+	open       bool
+	rwmutex    *sync.RWMutex
+}
+
+func newHub() *hub {
+	return &hub{
+		sessions:   make(map[*Session]bool),
+		broadcast:  make(chan *envelope),
+		register:   make(chan *Session),
+		unregister: make(chan *Session),
+		exit:       make(chan *envelope),
+		open:       true,
+		rwmutex:    &sync.RWMutex{},
+	}
+}
+
+func (h *hub) run() {
+loop:
+	for {
+		select {
+		case s := <-h.register:
+			h.rwmutex.Lock()
+			h.sessions[s] = true
+			h.rwmutex.Unlock()
+		case s := <-h.unregister:
+			h.rwmutex.Lock()
+			delete(h.sessions, s)
+			h.rwmutex.Unlock()
+		case m := <-h.broadcast:
+			// Fan-out always uses the non-blocking broadcastMessage, never
+			// writeMessage: this loop also serializes register/unregister,
+			// so a single session with BlockingWrite set and a full buffer
+			// must never be able to stall delivery to every other session.
+			h.rwmutex.RLock()
+			for s := range h.sessions {
+				if m.filter != nil && !m.filter(s) {
+					continue
+				}
+				if m.ignore == s {
+					continue
+				}
+				s.broadcastMessage(m)
+			}
+			h.rwmutex.RUnlock()
+		case m := <-h.exit:
+			h.rwmutex.Lock()
+			for s := range h.sessions {
+				s.broadcastMessage(m)
+				delete(h.sessions, s)
+			}
+			h.open = false
+			h.rwmutex.Unlock()
+			break loop
+		}
+	}
+}
+
+func (h *hub) closed() bool {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+	return !h.open
+}
+
+func (h *hub) len() int {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+	return len(h.sessions)
+}
+
+func (h *hub) all() []*Session {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+	all := make([]*Session, 0, len(h.sessions))
+	for s := range h.sessions {
+		all = append(all, s)
+	}
+	return all
+}
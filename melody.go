@@ -0,0 +1,369 @@
+package melody
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type handleMessageFunc func(*Session, []byte)
+type handleErrorFunc func(*Session, error)
+type handleCloseFunc func(*Session, int, string) error
+type handleSessionFunc func(*Session)
+type filterFunc func(*Session) bool
+
+// Config melody configuration struct.
+type Config struct {
+	WriteWait         time.Duration
+	PongWait          time.Duration
+	PingPeriod        time.Duration
+	MaxMessageSize    int64
+	MessageBufferSize int
+
+	// EnableCompression negotiates the permessage-deflate WebSocket extension
+	// (RFC 7692) for new connections and allows per-session writes to use it.
+	EnableCompression bool
+	// CompressionLevel is the flate compression level used when
+	// EnableCompression is true. See the compress/flate level constants.
+	CompressionLevel int
+	// CompressionThreshold is the minimum message size, in bytes, for which
+	// compression is applied. Messages smaller than this bypass the deflate
+	// path even when EnableCompression is true.
+	CompressionThreshold int
+
+	// HistorySize is the number of recent broadcast messages kept so they
+	// can be replayed to newly connected sessions via Session.Replay. Zero
+	// disables history.
+	HistorySize int
+
+	// BlockingWrite makes Write and WriteBinary block until output buffer
+	// space is available instead of dropping the message with
+	// errBufferIsFull when the writer is slow. WriteTimeout bounds how long
+	// they block; zero means block indefinitely (or until the session closes).
+	BlockingWrite bool
+	WriteTimeout  time.Duration
+
+	// MetricsCollector, if set, is notified of connect/disconnect/message/pong
+	// events so applications can plug in Prometheus, statsd, or similar
+	// without melody importing them directly.
+	MetricsCollector MetricsCollector
+}
+
+func newConfig() *Config {
+	return &Config{
+		WriteWait:            10 * time.Second,
+		PongWait:             60 * time.Second,
+		PingPeriod:           (60 * time.Second * 9) / 10,
+		MaxMessageSize:       512,
+		MessageBufferSize:    256,
+		EnableCompression:    false,
+		CompressionLevel:     flate.DefaultCompression,
+		CompressionThreshold: 1024,
+		HistorySize:          0,
+		BlockingWrite:        false,
+		WriteTimeout:         0,
+		MetricsCollector:     nil,
+	}
+}
+
+// Melody implements a websocket manager.
+type Melody struct {
+	Config                   *Config
+	Upgrader                 *websocket.Upgrader
+	messageHandler           handleMessageFunc
+	messageHandlerBinary     handleMessageFunc
+	messageSentHandler       handleMessageFunc
+	messageSentHandlerBinary handleMessageFunc
+	errorHandler             handleErrorFunc
+	closeHandler             handleCloseFunc
+	connectHandler           handleSessionFunc
+	disconnectHandler        handleSessionFunc
+	pongHandler              handleSessionFunc
+	hub                      *hub
+	history                  *historyRing
+	replayOnConnect          bool
+	metrics                  melodyMetrics
+	sseSessions              *sseRegistry
+}
+
+// New creates a new melody instance.
+func New() *Melody {
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+
+	hub := newHub()
+
+	go hub.run()
+
+	return &Melody{
+		Config:                   newConfig(),
+		Upgrader:                 upgrader,
+		messageHandler:           func(*Session, []byte) {},
+		messageHandlerBinary:     func(*Session, []byte) {},
+		messageSentHandler:       func(*Session, []byte) {},
+		messageSentHandlerBinary: func(*Session, []byte) {},
+		errorHandler:             func(*Session, error) {},
+		connectHandler:           func(*Session) {},
+		disconnectHandler:        func(*Session) {},
+		pongHandler:              func(*Session) {},
+		hub:                      hub,
+		history:                  newHistoryRing(),
+		sseSessions:              newSSERegistry(),
+	}
+}
+
+// HandleConnect sets the callback for when a session connects.
+func (m *Melody) HandleConnect(fn func(*Session)) {
+	m.connectHandler = fn
+}
+
+// HandleConnectWithHistory sets the callback for when a session connects,
+// and has each session replay the buffered broadcast history (see
+// Config.HistorySize and Session.Replay) before fn runs. Messages originally
+// sent via BroadcastFilter only replay to sessions the filter still accepts,
+// e.g. sessions whose Session.Keys match the room the message belonged to.
+func (m *Melody) HandleConnectWithHistory(fn func(*Session)) {
+	m.replayOnConnect = true
+	m.connectHandler = fn
+}
+
+// HandleDisconnect sets the callback for when a session disconnects.
+func (m *Melody) HandleDisconnect(fn func(*Session)) {
+	m.disconnectHandler = fn
+}
+
+// HandlePong sets the callback for when a pong is received from a session.
+func (m *Melody) HandlePong(fn func(*Session)) {
+	m.pongHandler = fn
+}
+
+// HandleMessage sets the callback for when a text message comes in.
+func (m *Melody) HandleMessage(fn func(*Session, []byte)) {
+	m.messageHandler = fn
+}
+
+// HandleMessageBinary sets the callback for when a binary message comes in.
+func (m *Melody) HandleMessageBinary(fn func(*Session, []byte)) {
+	m.messageHandlerBinary = fn
+}
+
+// HandleSentMessage sets the callback for when a text message is successfully sent.
+func (m *Melody) HandleSentMessage(fn func(*Session, []byte)) {
+	m.messageSentHandler = fn
+}
+
+// HandleSentMessageBinary sets the callback for when a binary message is successfully sent.
+func (m *Melody) HandleSentMessageBinary(fn func(*Session, []byte)) {
+	m.messageSentHandlerBinary = fn
+}
+
+// HandleError sets the callback for when an error occurs.
+func (m *Melody) HandleError(fn func(*Session, error)) {
+	m.errorHandler = fn
+}
+
+// HandleClose sets the callback for when a close frame is received.
+func (m *Melody) HandleClose(fn func(*Session, int, string) error) {
+	m.closeHandler = fn
+}
+
+// HandleRequest upgrades http requests to websocket connections and dispatches them to be handled by melody.
+func (m *Melody) HandleRequest(w http.ResponseWriter, r *http.Request) error {
+	return m.HandleRequestWithKeys(w, r, nil)
+}
+
+// HandleRequestWithKeys does the same as HandleRequest but populates session.Keys with keys.
+func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	m.Upgrader.EnableCompression = m.Config.EnableCompression
+
+	conn, err := m.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+
+	_, cancel := context.WithCancel(r.Context())
+
+	session := &Session{
+		Request:            r,
+		Keys:               keys,
+		conn:               conn,
+		output:             make(chan *envelope, m.Config.MessageBufferSize),
+		melody:             m,
+		open:               true,
+		rwmutex:            &sync.RWMutex{},
+		cancel:             cancel,
+		done:               make(chan struct{}),
+		compressionEnabled: m.Config.EnableCompression,
+	}
+
+	// Start writePump before Replay: Replay enqueues straight onto
+	// session.output, and with BlockingWrite set a history larger than
+	// MessageBufferSize would otherwise block forever with nothing draining
+	// the channel yet.
+	go session.writePump()
+
+	// Replay before registering with the hub: once registered, the session
+	// can receive a broadcast live via broadcastMessage, so replaying first
+	// guarantees a history message reaches this session at most once (either
+	// in this snapshot or, for anything broadcast afterwards, live) instead
+	// of landing in both. The cost is the inverse edge case: a broadcast
+	// racing exactly between the snapshot and registration below is missed
+	// rather than delivered twice.
+	if m.replayOnConnect {
+		session.Replay()
+	}
+
+	m.hub.register <- session
+
+	atomic.AddInt64(&m.metrics.totalConnects, 1)
+	if m.Config.MetricsCollector != nil {
+		m.Config.MetricsCollector.OnConnect(session)
+	}
+
+	m.connectHandler(session)
+
+	session.readPump()
+
+	m.hub.unregister <- session
+
+	session.close()
+
+	atomic.AddInt64(&m.metrics.totalDisconnects, 1)
+	if m.Config.MetricsCollector != nil {
+		m.Config.MetricsCollector.OnDisconnect(session)
+	}
+
+	m.disconnectHandler(session)
+
+	return nil
+}
+
+// Stats returns a snapshot of aggregate counters for this melody instance.
+func (m *Melody) Stats() Stats {
+	sessions := m.hub.all()
+
+	occupancy := 0
+	for _, s := range sessions {
+		occupancy += s.PendingCount()
+	}
+
+	return Stats{
+		ActiveSessions:     len(sessions),
+		TotalConnects:      atomic.LoadInt64(&m.metrics.totalConnects),
+		TotalDisconnects:   atomic.LoadInt64(&m.metrics.totalDisconnects),
+		TextMessagesSent:   atomic.LoadInt64(&m.metrics.textMessagesSent),
+		TextMessagesRecv:   atomic.LoadInt64(&m.metrics.textMessagesRecv),
+		BinaryMessagesSent: atomic.LoadInt64(&m.metrics.binaryMessagesSent),
+		BinaryMessagesRecv: atomic.LoadInt64(&m.metrics.binaryMessagesRecv),
+		BytesSent:          atomic.LoadInt64(&m.metrics.bytesSent),
+		BytesRecv:          atomic.LoadInt64(&m.metrics.bytesRecv),
+		BufferOccupancy:    occupancy,
+	}
+}
+
+// Broadcast broadcasts a text message to all sessions.
+func (m *Melody) Broadcast(msg []byte) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	message := &envelope{t: websocket.TextMessage, msg: msg}
+	m.hub.broadcast <- message
+	m.history.add(message, m.Config.HistorySize)
+
+	return nil
+}
+
+// BroadcastFilter broadcasts a text message to all sessions that fn returns true for.
+func (m *Melody) BroadcastFilter(msg []byte, fn func(*Session) bool) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	message := &envelope{t: websocket.TextMessage, msg: msg, filter: fn}
+	m.hub.broadcast <- message
+	m.history.add(message, m.Config.HistorySize)
+
+	return nil
+}
+
+// BroadcastOthers broadcasts a text message to all sessions except session s.
+func (m *Melody) BroadcastOthers(msg []byte, s *Session) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	m.hub.broadcast <- &envelope{t: websocket.TextMessage, msg: msg, ignore: s}
+
+	return nil
+}
+
+// BroadcastBinary broadcasts a binary message to all sessions.
+func (m *Melody) BroadcastBinary(msg []byte) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	message := &envelope{t: websocket.BinaryMessage, msg: msg}
+	m.hub.broadcast <- message
+	m.history.add(message, m.Config.HistorySize)
+
+	return nil
+}
+
+// BroadcastBinaryFilter broadcasts a binary message to all sessions that fn returns true for.
+func (m *Melody) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	message := &envelope{t: websocket.BinaryMessage, msg: msg, filter: fn}
+	m.hub.broadcast <- message
+	m.history.add(message, m.Config.HistorySize)
+
+	return nil
+}
+
+// Close closes the melody instance and all connected sessions.
+func (m *Melody) Close() error {
+	if m.hub.closed() {
+		return errors.New("melody instance is already closed")
+	}
+
+	m.hub.exit <- &envelope{t: websocket.CloseMessage, msg: []byte{}}
+
+	return nil
+}
+
+// CloseWithMsg closes the melody instance with the provided close payload.
+func (m *Melody) CloseWithMsg(msg []byte) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is already closed")
+	}
+
+	m.hub.exit <- &envelope{t: websocket.CloseMessage, msg: msg}
+
+	return nil
+}
+
+// Len return the number of connected sessions.
+func (m *Melody) Len() int {
+	return m.hub.len()
+}
+
+// IsClosed returns the status of the melody instance.
+func (m *Melody) IsClosed() bool {
+	return m.hub.closed()
+}
@@ -0,0 +1,19 @@
+package melody
+
+import "github.com/gorilla/websocket"
+
+// envelope represents a single outbound frame queued on a Session's output
+// channel, along with the broadcast filter/ignore rules used to select
+// which sessions it is delivered to.
+type envelope struct {
+	t             int
+	msg           []byte
+	filter        filterFunc
+	ignore        *Session
+	forceCompress bool
+}
+
+// FormatCloseMessage formats closeCode and text as a WebSocket close message.
+func FormatCloseMessage(closeCode int, text string) []byte {
+	return websocket.FormatCloseMessage(closeCode, text)
+}
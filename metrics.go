@@ -0,0 +1,63 @@
+package melody
+
+import "time"
+
+// MetricsCollector receives lifecycle and traffic events from a Melody
+// instance so applications can plug in Prometheus, statsd, or any other
+// backend without melody importing them directly.
+type MetricsCollector interface {
+	OnConnect(s *Session)
+	OnMessage(s *Session, messageType int, size int)
+	OnPong(s *Session, rtt time.Duration)
+	OnDisconnect(s *Session)
+}
+
+// melodyMetrics holds the atomic counters backing Melody.Stats. Fields are
+// only ever accessed through the sync/atomic package.
+type melodyMetrics struct {
+	totalConnects      int64
+	totalDisconnects   int64
+	textMessagesSent   int64
+	textMessagesRecv   int64
+	binaryMessagesSent int64
+	binaryMessagesRecv int64
+	bytesSent          int64
+	bytesRecv          int64
+}
+
+// Stats is a snapshot of aggregate counters for a Melody instance.
+type Stats struct {
+	ActiveSessions     int
+	TotalConnects      int64
+	TotalDisconnects   int64
+	TextMessagesSent   int64
+	TextMessagesRecv   int64
+	BinaryMessagesSent int64
+	BinaryMessagesRecv int64
+	BytesSent          int64
+	BytesRecv          int64
+	BufferOccupancy    int
+}
+
+// sessionMetrics holds the atomic counters backing Session.Stats. Fields
+// are only ever accessed through the sync/atomic package.
+type sessionMetrics struct {
+	textMessagesSent   int64
+	textMessagesRecv   int64
+	binaryMessagesSent int64
+	binaryMessagesRecv int64
+	bytesSent          int64
+	bytesRecv          int64
+}
+
+// SessionStats is a snapshot of a single session's traffic counters and
+// latest round-trip time estimate.
+type SessionStats struct {
+	TextMessagesSent   int64
+	TextMessagesRecv   int64
+	BinaryMessagesSent int64
+	BinaryMessagesRecv int64
+	BytesSent          int64
+	BytesRecv          int64
+	RTT                time.Duration
+}
@@ -1,9 +1,14 @@
 package melody
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,8 +19,13 @@ var (
 	errWriteToClosedSession error = errors.New("tried to write to a closed session")
 	errBufferIsFull         error = errors.New("session message buffer is full")
 	errSessionAlreadyClosed error = errors.New("session is already closed")
+	errSSEBinaryUnsupported error = errors.New("melody: binary messages are not supported on SSE sessions")
 )
 
+// flushPollInterval is how often Flush checks whether the output buffer
+// has drained.
+const flushPollInterval = 10 * time.Millisecond
+
 // Session wrapper around websocket connections.
 type Session struct {
 	Request *http.Request
@@ -25,6 +35,30 @@ type Session struct {
 	melody  *Melody
 	open    bool
 	rwmutex *sync.RWMutex
+
+	// sseWriter and sseFlusher are set instead of conn for sessions created
+	// by HandleRequestSSE, and make writeRaw emit SSE frames rather than
+	// WebSocket ones.
+	sseWriter  http.ResponseWriter
+	sseFlusher http.Flusher
+
+	// cancel, done and closeErr back the session's use as a context.Context:
+	// cancel is invoked and done is closed from close(), and closeErr records
+	// why, so handlers using *Session as their context can observe disconnects.
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closeErr error
+
+	// compressionEnabled mirrors Config.EnableCompression but can be toggled
+	// per session via SetCompressionEnabled, e.g. to skip deflate for a
+	// session known to only send already-compressed payloads.
+	compressionEnabled bool
+
+	// metrics, pingSentAt and rtt back Session.Stats. pingSentAt and rtt are
+	// UnixNano/Duration values accessed only via sync/atomic.
+	metrics    sessionMetrics
+	pingSentAt int64
+	rtt        int64
 }
 
 // Conn returns underlying websocket connection
@@ -37,14 +71,27 @@ func (s *Session) Deadline() (deadline time.Time, ok bool) {
 	return
 }
 
-// Done always returns nil (chan which will wait forever),
+// Done returns a channel that is closed once the session's underlying
+// websocket connection has been closed, allowing handlers that pass *Session
+// as a context.Context to abort in-flight work when the peer disconnects.
 func (s *Session) Done() <-chan struct{} {
-	return nil
+	return s.done
 }
 
-// Err always returns nil
+// Err returns context.Canceled once the session has been closed, or the
+// error that caused the underlying connection to close, if any. It returns
+// nil while the session is still open.
 func (s *Session) Err() error {
-	return nil
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	if s.open {
+		return nil
+	}
+	if s.closeErr != nil {
+		return s.closeErr
+	}
+	return context.Canceled
 }
 
 // Value returns the value associated with this context for key, or nil
@@ -59,12 +106,71 @@ func (s *Session) Value(key interface{}) interface{} {
 	return nil
 }
 
+// sseRejectsBinary reports and drops binary envelopes destined for an SSE
+// session, since SSE is a text-only protocol, and reports true so the
+// caller does not enqueue the message.
+func (s *Session) sseRejectsBinary(message *envelope) bool {
+	if s.sseWriter == nil || message.t != websocket.BinaryMessage {
+		return false
+	}
+	s.melody.errorHandler(s, errSSEBinaryUnsupported)
+	return true
+}
+
 func (s *Session) writeMessage(message *envelope) {
 	if s.closed() {
 		s.melody.errorHandler(s, errWriteToClosedSession)
 		return
 	}
 
+	if s.sseRejectsBinary(message) {
+		return
+	}
+
+	if !s.melody.Config.BlockingWrite {
+		select {
+		case s.output <- message:
+		default:
+			s.melody.errorHandler(s, errBufferIsFull)
+		}
+		return
+	}
+
+	if s.melody.Config.WriteTimeout <= 0 {
+		select {
+		case s.output <- message:
+		case <-s.done:
+			s.melody.errorHandler(s, errWriteToClosedSession)
+		}
+		return
+	}
+
+	timer := time.NewTimer(s.melody.Config.WriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.output <- message:
+	case <-timer.C:
+		s.melody.errorHandler(s, errBufferIsFull)
+	case <-s.done:
+		s.melody.errorHandler(s, errWriteToClosedSession)
+	}
+}
+
+// broadcastMessage delivers a broadcast envelope to the session without
+// ever blocking, regardless of Config.BlockingWrite. It is used by hub.run,
+// which serializes all broadcasts plus register/unregister on one
+// goroutine; a single slow session must never stall delivery to the rest.
+func (s *Session) broadcastMessage(message *envelope) {
+	if s.closed() {
+		s.melody.errorHandler(s, errWriteToClosedSession)
+		return
+	}
+
+	if s.sseRejectsBinary(message) {
+		return
+	}
+
 	select {
 	case s.output <- message:
 	default:
@@ -72,11 +178,42 @@ func (s *Session) writeMessage(message *envelope) {
 	}
 }
 
+// writeMessageContext enqueues message on the output buffer, blocking until
+// space is available, ctx is cancelled, or the session closes.
+func (s *Session) writeMessageContext(ctx context.Context, message *envelope) error {
+	if s.closed() {
+		return errWriteToClosedSession
+	}
+
+	if s.sseRejectsBinary(message) {
+		return errSSEBinaryUnsupported
+	}
+
+	select {
+	case s.output <- message:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return errWriteToClosedSession
+	}
+}
+
 func (s *Session) writeRaw(message *envelope) error {
 	if s.closed() {
 		return errWriteToClosedSession
 	}
 
+	if s.sseWriter != nil {
+		return s.writeSSE(message)
+	}
+
+	if s.melody.Config.EnableCompression {
+		enable := s.compressionAllowed() &&
+			(message.forceCompress || len(message.msg) >= s.melody.Config.CompressionThreshold)
+		s.conn.EnableWriteCompression(enable)
+	}
+
 	s.conn.SetWriteDeadline(time.Now().Add(s.melody.Config.WriteWait))
 	err := s.conn.WriteMessage(message.t, message.msg)
 
@@ -87,6 +224,36 @@ func (s *Session) writeRaw(message *envelope) error {
 	return nil
 }
 
+// writeSSE writes message as a Server-Sent Events frame and flushes it to
+// the client. Ping envelopes become SSE comment lines, since SSE has no
+// native keepalive frame, and close envelopes cancel the session's context
+// so HandleRequestSSE can end the stream.
+func (s *Session) writeSSE(message *envelope) error {
+	switch message.t {
+	case websocket.PingMessage:
+		fmt.Fprint(s.sseWriter, ": ping\n\n")
+	case websocket.CloseMessage:
+		s.cancel()
+	default:
+		writeSSEData(s.sseWriter, message.msg)
+	}
+
+	s.sseFlusher.Flush()
+
+	return nil
+}
+
+// writeSSEData writes msg as one "data: " line per line of msg, per the SSE
+// spec, so a payload containing newlines is delivered as a single event
+// instead of being split into a malformed one. Binary messages never reach
+// here; see sseRejectsBinary.
+func writeSSEData(w io.Writer, msg []byte) {
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
 func (s *Session) closed() (b bool) {
 	s.rwmutex.RLock()
 	b = !s.open
@@ -97,17 +264,86 @@ func (s *Session) closed() (b bool) {
 func (s *Session) close() {
 	if !s.closed() {
 		s.rwmutex.Lock()
-		close(s.output)
 		s.open = false
 		s.rwmutex.Unlock()
-		s.conn.Close()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.cancel()
+		// s.output is deliberately never closed: writers blocked on a send
+		// (see writeMessage's BlockingWrite path) select on s.done instead,
+		// so closing s.output here could race a parked send and panic.
+		close(s.done)
 	}
 }
 
+// setCloseErr records the error that is causing the session to close, so
+// that it is later reported by Err(). Only the first error is kept.
+func (s *Session) setCloseErr(err error) {
+	s.rwmutex.Lock()
+	if s.closeErr == nil {
+		s.closeErr = err
+	}
+	s.rwmutex.Unlock()
+}
+
 func (s *Session) ping() {
+	atomic.StoreInt64(&s.pingSentAt, time.Now().UnixNano())
 	s.writeRaw(&envelope{t: websocket.PingMessage, msg: []byte{}})
 }
 
+// recordPong computes the round-trip time since the last ping was sent and
+// reports it through Config.MetricsCollector, if set.
+func (s *Session) recordPong() {
+	sentAt := atomic.LoadInt64(&s.pingSentAt)
+	if sentAt == 0 {
+		return
+	}
+
+	rtt := time.Since(time.Unix(0, sentAt))
+	atomic.StoreInt64(&s.rtt, int64(rtt))
+
+	if s.melody.Config.MetricsCollector != nil {
+		s.melody.Config.MetricsCollector.OnPong(s, rtt)
+	}
+}
+
+// recordMessageSent updates traffic counters after a message of the given
+// type and size has been written to the connection.
+func (s *Session) recordMessageSent(t int, size int) {
+	if t == websocket.TextMessage {
+		atomic.AddInt64(&s.metrics.textMessagesSent, 1)
+		atomic.AddInt64(&s.melody.metrics.textMessagesSent, 1)
+	} else {
+		atomic.AddInt64(&s.metrics.binaryMessagesSent, 1)
+		atomic.AddInt64(&s.melody.metrics.binaryMessagesSent, 1)
+	}
+	atomic.AddInt64(&s.metrics.bytesSent, int64(size))
+	atomic.AddInt64(&s.melody.metrics.bytesSent, int64(size))
+
+	if s.melody.Config.MetricsCollector != nil {
+		s.melody.Config.MetricsCollector.OnMessage(s, t, size)
+	}
+}
+
+// recordMessageRecv updates traffic counters after a message of the given
+// type and size has been read from the connection.
+func (s *Session) recordMessageRecv(t int, size int) {
+	if t == websocket.TextMessage {
+		atomic.AddInt64(&s.metrics.textMessagesRecv, 1)
+		atomic.AddInt64(&s.melody.metrics.textMessagesRecv, 1)
+	} else {
+		atomic.AddInt64(&s.metrics.binaryMessagesRecv, 1)
+		atomic.AddInt64(&s.melody.metrics.binaryMessagesRecv, 1)
+	}
+	atomic.AddInt64(&s.metrics.bytesRecv, int64(size))
+	atomic.AddInt64(&s.melody.metrics.bytesRecv, int64(size))
+
+	if s.melody.Config.MetricsCollector != nil {
+		s.melody.Config.MetricsCollector.OnMessage(s, t, size)
+	}
+}
+
 func (s *Session) writePump() {
 	ticker := time.NewTicker(s.melody.Config.PingPeriod)
 	defer ticker.Stop()
@@ -115,15 +351,14 @@ func (s *Session) writePump() {
 loop:
 	for {
 		select {
-		case msg, ok := <-s.output:
-			if !ok {
-				break loop
-			}
-
+		case <-s.done:
+			break loop
+		case msg := <-s.output:
 			err := s.writeRaw(msg)
 
 			if err != nil {
 				s.melody.errorHandler(s, err)
+				s.setCloseErr(err)
 				break loop
 			}
 
@@ -132,10 +367,12 @@ loop:
 			}
 
 			if msg.t == websocket.TextMessage {
+				s.recordMessageSent(websocket.TextMessage, len(msg.msg))
 				s.melody.messageSentHandler(s, msg.msg)
 			}
 
 			if msg.t == websocket.BinaryMessage {
+				s.recordMessageSent(websocket.BinaryMessage, len(msg.msg))
 				s.melody.messageSentHandlerBinary(s, msg.msg)
 			}
 		case <-ticker.C:
@@ -148,8 +385,13 @@ func (s *Session) readPump() {
 	s.conn.SetReadLimit(s.melody.Config.MaxMessageSize)
 	s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
 
+	if s.melody.Config.EnableCompression {
+		s.conn.SetCompressionLevel(s.melody.Config.CompressionLevel)
+	}
+
 	s.conn.SetPongHandler(func(string) error {
 		s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
+		s.recordPong()
 		s.melody.pongHandler(s)
 		return nil
 	})
@@ -165,14 +407,17 @@ func (s *Session) readPump() {
 
 		if err != nil {
 			s.melody.errorHandler(s, err)
+			s.setCloseErr(err)
 			break
 		}
 
 		if t == websocket.TextMessage {
+			s.recordMessageRecv(websocket.TextMessage, len(message))
 			s.melody.messageHandler(s, message)
 		}
 
 		if t == websocket.BinaryMessage {
+			s.recordMessageRecv(websocket.BinaryMessage, len(message))
 			s.melody.messageHandlerBinary(s, message)
 		}
 	}
@@ -200,6 +445,129 @@ func (s *Session) WriteBinary(msg []byte) error {
 	return nil
 }
 
+// WriteCompressed writes a text message to the session, forcing permessage-deflate
+// compression on regardless of Config.CompressionThreshold. Config.EnableCompression
+// and the session's own compression setting (see SetCompressionEnabled) still apply.
+func (s *Session) WriteCompressed(msg []byte) error {
+	if s.closed() {
+		return errWriteToClosedSession
+	}
+
+	s.writeMessage(&envelope{t: websocket.TextMessage, msg: msg, forceCompress: true})
+
+	return nil
+}
+
+// WriteBinaryCompressed writes a binary message to the session, forcing permessage-deflate
+// compression on regardless of Config.CompressionThreshold. Config.EnableCompression
+// and the session's own compression setting (see SetCompressionEnabled) still apply.
+func (s *Session) WriteBinaryCompressed(msg []byte) error {
+	if s.closed() {
+		return errWriteToClosedSession
+	}
+
+	s.writeMessage(&envelope{t: websocket.BinaryMessage, msg: msg, forceCompress: true})
+
+	return nil
+}
+
+// SetCompressionEnabled turns permessage-deflate compression on or off for this
+// session alone. Handlers can use this to disable compression for a session
+// that only ever sends small or already-compressed payloads. It has no effect
+// while Config.EnableCompression is false, since the extension is then not
+// negotiated and no message is compressed.
+func (s *Session) SetCompressionEnabled(enabled bool) {
+	s.rwmutex.Lock()
+	s.compressionEnabled = enabled
+	s.rwmutex.Unlock()
+}
+
+// compressionAllowed reports whether compression is currently enabled for
+// this session. It reads compressionEnabled under rwmutex, since it is
+// written concurrently by SetCompressionEnabled.
+func (s *Session) compressionAllowed() bool {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+	return s.compressionEnabled
+}
+
+// Replay streams the melody instance's buffered broadcast history (see
+// Config.HistorySize) to this session. A message only replays if it was
+// broadcast without a filter, or its BroadcastFilter still accepts this
+// session, so e.g. a room key stored in Session.Keys keeps replay scoped
+// to the right room. Callers should invoke Replay before registering the
+// session with the hub, so a history message is delivered at most once
+// (via this snapshot, or live afterwards) rather than both ways.
+func (s *Session) Replay() {
+	for _, message := range s.melody.history.snapshot() {
+		if message.filter != nil && !message.filter(s) {
+			continue
+		}
+		s.writeMessage(message)
+	}
+}
+
+// WriteContext writes a text message to the session, blocking until output
+// buffer space is available or ctx is cancelled, instead of dropping the
+// message the way Write does when the buffer is full.
+func (s *Session) WriteContext(ctx context.Context, msg []byte) error {
+	return s.writeMessageContext(ctx, &envelope{t: websocket.TextMessage, msg: msg})
+}
+
+// WriteBinaryContext writes a binary message to the session, blocking until
+// output buffer space is available or ctx is cancelled, instead of dropping
+// the message the way WriteBinary does when the buffer is full.
+func (s *Session) WriteBinaryContext(ctx context.Context, msg []byte) error {
+	return s.writeMessageContext(ctx, &envelope{t: websocket.BinaryMessage, msg: msg})
+}
+
+// PendingCount returns the number of messages currently queued in the
+// session's output buffer, waiting to be written to the connection.
+func (s *Session) PendingCount() int {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	if !s.open {
+		return 0
+	}
+	return len(s.output)
+}
+
+// Flush blocks until the session's output buffer has drained, or until ctx
+// is cancelled or the session closes. Callers building request/response
+// flows on top of melody can use it for flow control instead of racing
+// against a full buffer.
+func (s *Session) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+
+	for s.PendingCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.done:
+			return errWriteToClosedSession
+		}
+	}
+
+	return nil
+}
+
+// Stats returns a snapshot of this session's traffic counters and latest
+// round-trip time estimate, computed from ping/pong timestamps.
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		TextMessagesSent:   atomic.LoadInt64(&s.metrics.textMessagesSent),
+		TextMessagesRecv:   atomic.LoadInt64(&s.metrics.textMessagesRecv),
+		BinaryMessagesSent: atomic.LoadInt64(&s.metrics.binaryMessagesSent),
+		BinaryMessagesRecv: atomic.LoadInt64(&s.metrics.binaryMessagesRecv),
+		BytesSent:          atomic.LoadInt64(&s.metrics.bytesSent),
+		BytesRecv:          atomic.LoadInt64(&s.metrics.bytesRecv),
+		RTT:                time.Duration(atomic.LoadInt64(&s.rtt)),
+	}
+}
+
 // Close closes session.
 func (s *Session) Close() error {
 	if s.closed() {
@@ -223,7 +591,7 @@ func (s *Session) CloseWithMsg(msg []byte) error {
 	return nil
 }
 
-//CloseWithErr closes the session with the provided error.
+// CloseWithErr closes the session with the provided error.
 func (s *Session) CloseWithErr(err error) error {
 	if s.closed() {
 		return errSessionAlreadyClosed
@@ -0,0 +1,189 @@
+package melody
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// sseSessionIDKey is the Session.Keys entry holding the id HandleSSEMessage
+// uses to route a POSTed client message back to this session.
+const sseSessionIDKey = "sse_session_id"
+
+// sseRegistry looks up SSE sessions by the id handed out in
+// Session.Keys[sseSessionIDKey], so HandleSSEMessage can find the session a
+// POSTed client message belongs to.
+type sseRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func newSSERegistry() *sseRegistry {
+	return &sseRegistry{sessions: make(map[string]*Session)}
+}
+
+func (r *sseRegistry) put(id string, s *Session) {
+	r.mu.Lock()
+	r.sessions[id] = s
+	r.mu.Unlock()
+}
+
+func (r *sseRegistry) delete(id string) {
+	r.mu.Lock()
+	delete(r.sessions, id)
+	r.mu.Unlock()
+}
+
+func (r *sseRegistry) get(id string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// nextSSESessionID generates an unguessable session id: it is accepted,
+// unauthenticated, on HandleSSEMessage, so a sequential or otherwise
+// predictable id would let one client inject messages into another client's
+// session. The id is only stored in Session.Keys[sseSessionIDKey]; melody
+// does not send it to the client itself.
+func (m *Melody) nextSSESessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("melody: failed to generate SSE session id: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// HandleRequestSSE upgrades r to a Server-Sent Events stream and runs it
+// through the same handler registry as HandleRequest (HandleConnect,
+// HandleMessage, HandleDisconnect, Broadcast, Session.Keys, ...), so a
+// melody instance can serve both a WebSocket and an SSE endpoint, choosing
+// per client, without rewriting message handling logic. Client-to-server
+// messages arrive over a companion endpoint; see HandleSSEMessage.
+func (m *Melody) HandleRequestSSE(w http.ResponseWriter, r *http.Request) error {
+	return m.HandleRequestSSEWithKeys(w, r, nil)
+}
+
+// HandleRequestSSEWithKeys does the same as HandleRequestSSE but also
+// populates session.Keys with keys.
+func (m *Melody) HandleRequestSSEWithKeys(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("melody: response writer does not support flushing, required for SSE")
+	}
+
+	if keys == nil {
+		keys = make(map[string]interface{})
+	}
+
+	id := m.nextSSESessionID()
+	keys[sseSessionIDKey] = id
+
+	ctx, cancel := context.WithCancel(r.Context())
+
+	session := &Session{
+		Request:    r,
+		Keys:       keys,
+		output:     make(chan *envelope, m.Config.MessageBufferSize),
+		melody:     m,
+		open:       true,
+		rwmutex:    &sync.RWMutex{},
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		sseWriter:  w,
+		sseFlusher: flusher,
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Start writePump before Replay: Replay enqueues straight onto
+	// session.output, and with BlockingWrite set a history larger than
+	// MessageBufferSize would otherwise block forever with nothing draining
+	// the channel yet.
+	go session.writePump()
+
+	// Replay before registering with the hub: once registered, the session
+	// can receive a broadcast live via broadcastMessage, so replaying first
+	// guarantees a history message reaches this session at most once (either
+	// in this snapshot or, for anything broadcast afterwards, live) instead
+	// of landing in both. The cost is the inverse edge case: a broadcast
+	// racing exactly between the snapshot and registration below is missed
+	// rather than delivered twice.
+	if m.replayOnConnect {
+		session.Replay()
+	}
+
+	m.hub.register <- session
+	m.sseSessions.put(id, session)
+
+	atomic.AddInt64(&m.metrics.totalConnects, 1)
+	if m.Config.MetricsCollector != nil {
+		m.Config.MetricsCollector.OnConnect(session)
+	}
+
+	m.connectHandler(session)
+
+	<-ctx.Done()
+
+	m.sseSessions.delete(id)
+	m.hub.unregister <- session
+
+	session.close()
+
+	atomic.AddInt64(&m.metrics.totalDisconnects, 1)
+	if m.Config.MetricsCollector != nil {
+		m.Config.MetricsCollector.OnDisconnect(session)
+	}
+
+	m.disconnectHandler(session)
+
+	return nil
+}
+
+// HandleSSEMessage is the companion POST endpoint for HandleRequestSSE:
+// clients send their outbound frames here, keyed by the
+// "sse_session_id" query parameter copied from their Session.Keys, and the
+// body is dispatched through the same HandleMessage handler a WebSocket
+// session's messages would go through.
+func (m *Melody) HandleSSEMessage(w http.ResponseWriter, r *http.Request) error {
+	id := r.URL.Query().Get(sseSessionIDKey)
+	if id == "" {
+		http.Error(w, "missing "+sseSessionIDKey, http.StatusBadRequest)
+		return errors.New("melody: missing sse session id")
+	}
+
+	session, ok := m.sseSessions.get(id)
+	if !ok {
+		http.Error(w, "unknown "+sseSessionIDKey, http.StatusNotFound)
+		return errors.New("melody: unknown sse session id")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	session.recordMessageRecv(websocket.TextMessage, len(body))
+	m.messageHandler(session, body)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}